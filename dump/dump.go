@@ -0,0 +1,150 @@
+// Package dump renders proxied transactions as colorized, human-readable
+// text for the proxy's interactive dump mode (config.yaml's `dump: true`),
+// transparently decompressing gzip/deflate bodies and hex-summarizing
+// binary content along the way. It has no dependency on the rest of the
+// proxy so future subcommands can reuse it.
+package dump
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ANSI color codes, chosen so a stream of transactions is scannable by
+// status class at a glance.
+const (
+	colorReset   = "\033[0m"
+	colorBlue    = "\033[34m"
+	colorGreen   = "\033[32m"
+	colorYellow  = "\033[33m"
+	colorMagenta = "\033[35m"
+	colorRed     = "\033[31m"
+)
+
+// Transaction is everything Print needs to render one request/response
+// pair; RespBody should already be decompressed (see DecodeBody).
+type Transaction struct {
+	Method     string
+	URL        string
+	Status     int
+	RespHeader http.Header
+	RespBody   []byte
+}
+
+// DecodeBody reads resp.Body, transparently decompressing it according to
+// its Content-Encoding (gzip or deflate, passed through unchanged
+// otherwise), and restores resp.Body to its original (still-encoded) bytes
+// so callers further down the chain see exactly what the origin sent.
+func DecodeBody(resp *http.Response) ([]byte, error) {
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(raw))
+
+	decoded, err := decompress(raw, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress response body: %w", err)
+	}
+	return decoded, nil
+}
+
+func decompress(raw []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	case "deflate":
+		fl := flate.NewReader(bytes.NewReader(raw))
+		defer fl.Close()
+		return ioutil.ReadAll(fl)
+	default:
+		return raw, nil
+	}
+}
+
+// Print writes a colorized rendering of tx to w: method in blue, status
+// colored by class (2xx green, 3xx yellow, 4xx magenta, 5xx red), and the
+// body truncated past maxDumpBytes or hex-summarized if it looks binary.
+func Print(w io.Writer, tx Transaction, maxDumpBytes int) {
+	fmt.Fprintf(w, "%s%s%s %s %s%d%s\n",
+		colorBlue, tx.Method, colorReset,
+		tx.URL,
+		statusColor(tx.Status), tx.Status, colorReset)
+
+	if body := formatBody(tx.RespBody, tx.RespHeader.Get("Content-Type"), maxDumpBytes); body != "" {
+		fmt.Fprintln(w, body)
+	}
+}
+
+func formatBody(body []byte, contentType string, maxDumpBytes int) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	detected := contentType
+	if detected == "" {
+		detected = http.DetectContentType(body)
+	}
+
+	if IsBinary(detected) {
+		return hexSummary(body, maxDumpBytes)
+	}
+
+	if maxDumpBytes > 0 && len(body) > maxDumpBytes {
+		return fmt.Sprintf("%s\n... truncated, %d of %d bytes shown", body[:maxDumpBytes], maxDumpBytes, len(body))
+	}
+	return string(body)
+}
+
+// IsBinary treats anything that isn't recognizably text as binary. Used to
+// decide between hex-summarizing a body for the terminal (here) and
+// base64-encoding it for storage (txlog.go's TxLogger).
+func IsBinary(contentType string) bool {
+	for _, textish := range []string{"text/", "json", "xml", "javascript", "urlencoded"} {
+		if strings.Contains(contentType, textish) {
+			return false
+		}
+	}
+	return true
+}
+
+func hexSummary(body []byte, maxDumpBytes int) string {
+	n := len(body)
+	if maxDumpBytes > 0 && n > maxDumpBytes {
+		n = maxDumpBytes
+	}
+
+	summary := hex.EncodeToString(body[:n])
+	if n < len(body) {
+		return fmt.Sprintf("%s... (binary, %d of %d bytes shown)", summary, n, len(body))
+	}
+	return fmt.Sprintf("%s (binary, %d bytes)", summary, len(body))
+}
+
+func statusColor(status int) string {
+	switch {
+	case status >= 500:
+		return colorRed
+	case status >= 400:
+		return colorMagenta
+	case status >= 300:
+		return colorYellow
+	case status >= 200:
+		return colorGreen
+	default:
+		return colorReset
+	}
+}
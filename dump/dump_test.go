@@ -0,0 +1,25 @@
+package dump
+
+import "testing"
+
+func TestIsBinary(t *testing.T) {
+	cases := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/plain; charset=utf-8", false},
+		{"application/json", false},
+		{"application/xml", false},
+		{"text/javascript", false},
+		{"application/x-www-form-urlencoded", false},
+		{"image/png", true},
+		{"application/octet-stream", true},
+		{"application/pdf", true},
+		{"application/zip", true},
+	}
+	for _, c := range cases {
+		if got := IsBinary(c.contentType); got != c.want {
+			t.Errorf("IsBinary(%q) = %v, want %v", c.contentType, got, c.want)
+		}
+	}
+}
@@ -1,24 +1,66 @@
 package main
 
 import (
-	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/elazarl/goproxy"
 	"gopkg.in/yaml.v2"
+
+	"go_proxy/dump"
 )
 
 type Config struct {
 	Port         string `yaml:"port"`
 	TargetServer string `yaml:"target_server"`
+
+	// MITM interception (see mitm.go)
+	MitmEnabled   bool   `yaml:"mitm_enabled"`
+	CACertPath    string `yaml:"ca_cert_path"`
+	CAKeyPath     string `yaml:"ca_key_path"`
+	CertCacheSize int    `yaml:"cert_cache_size"`
+
+	// Rule-based blocking/rewriting (see rules.go)
+	Rules []RuleConfig `yaml:"rules"`
+
+	// Upstream proxy pool (see pool.go)
+	ProxyPoolOurs          []string `yaml:"proxy_pool_ours"`
+	ProxyPoolThirdparty    []string `yaml:"proxy_pool_thirdparty"`
+	ProxySelectionStrategy string   `yaml:"proxy_selection_strategy"`
+	BypassDomains          []string `yaml:"bypass_domains"`
+	IPCheckerURL           string   `yaml:"ip_checker_url"`
+	ProxyConnectTimeout    int      `yaml:"proxy_connect_timeout"` // seconds
+	HealthCheckInterval    int      `yaml:"health_check_interval"` // seconds
+	PoolAdminAddr          string   `yaml:"pool_admin_addr"`
+
+	// Structured transaction logging (see txlog.go)
+	LogFormat       string `yaml:"log_format"` // text, json or har
+	LogBufSize      int    `yaml:"log_buf_size"`
+	LogMaxSizeBytes int64  `yaml:"log_max_size_bytes"`
+
+	// Interactive dump mode (see dump package)
+	Dump         bool `yaml:"dump"`
+	MaxDumpBytes int  `yaml:"max_dump_bytes"`
 }
 
 func main() {
+	// `go_proxy replay -log <file> -target <url>` re-issues a captured
+	// transaction log against a target server instead of starting the proxy.
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatalf("replay: %v", err)
+		}
+		return
+	}
+
 	// Load configuration file
 	config, err := loadConfig("config.yaml")
 	if err != nil {
@@ -30,29 +72,47 @@ func main() {
 		log.Fatalf("Failed to create logs directory: %v", err)
 	}
 
-	// Open or create log files
-	requestLogFile, err := os.OpenFile("logs/request.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	errorLogFile, err := os.OpenFile("logs/error.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
-		log.Fatalf("Failed to open request log file: %v", err)
+		log.Fatalf("Failed to open error log file: %v", err)
 	}
-	defer requestLogFile.Close()
+	defer errorLogFile.Close()
+	errorLogger := log.New(io.MultiWriter(os.Stderr, errorLogFile), "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
 
-	responseLogFile, err := os.OpenFile("logs/response.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	txLogPath := fmt.Sprintf("logs/transactions.%s", logFileExtension(config.LogFormat))
+	txLogger, err := NewTxLogger(txLogPath, config.LogFormat, config.LogBufSize, config.LogMaxSizeBytes)
 	if err != nil {
-		log.Fatalf("Failed to open response log file: %v", err)
+		log.Fatalf("Failed to open transaction log: %v", err)
 	}
-	defer responseLogFile.Close()
 
-	errorLogFile, err := os.OpenFile("logs/error.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	// Compile the initial rule set and start watching for SIGHUP to
+	// hot-reload config.yaml without restarting the proxy.
+	rules := newRuleEngine()
+	compiled, err := compileRules(config.Rules)
 	if err != nil {
-		log.Fatalf("Failed to open error log file: %v", err)
+		log.Fatalf("Failed to compile rules: %v", err)
 	}
-	defer errorLogFile.Close()
+	rules.set(compiled)
+	watchForConfigReload(rules, errorLogger)
 
-	// Set log output destinations
-	requestLogger := log.New(io.MultiWriter(os.Stdout, requestLogFile), "REQUEST: ", log.Ldate|log.Ltime|log.Lshortfile)
-	responseLogger := log.New(io.MultiWriter(os.Stdout, responseLogFile), "RESPONSE: ", log.Ldate|log.Ltime|log.Lshortfile)
-	errorLogger := log.New(io.MultiWriter(os.Stderr, errorLogFile), "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	// Set up the upstream proxy pool and its background health checker
+	pool, err := newProxyPool(config)
+	if err != nil {
+		log.Fatalf("Failed to build upstream proxy pool: %v", err)
+	}
+	connectTimeout := time.Duration(config.ProxyConnectTimeout) * time.Second
+	healthCheckInterval := time.Duration(config.HealthCheckInterval) * time.Second
+	startHealthChecker(pool, config.IPCheckerURL, connectTimeout, healthCheckInterval, errorLogger)
+
+	if config.PoolAdminAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/pool", poolAdminHandler(pool))
+			if err := http.ListenAndServe(config.PoolAdminAddr, mux); err != nil {
+				errorLogger.Printf("Pool admin server stopped: %v", err)
+			}
+		}()
+	}
 
 	// Create goproxy instance
 	proxy := goproxy.NewProxyHttpServer()
@@ -60,9 +120,15 @@ func main() {
 
 	// Redirect proxy requests to custom target
 	proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		redirectHandler(w, req, config.TargetServer, requestLogger, responseLogger, errorLogger)
+		redirectHandler(w, req, config.TargetServer, rules, pool, connectTimeout, txLogger, config.Dump, config.MaxDumpBytes, errorLogger)
 	})
 
+	if config.MitmEnabled {
+		if err := setupMitm(config, proxy, rules, txLogger, errorLogger); err != nil {
+			errorLogger.Fatalf("Failed to set up MITM interception: %v", err)
+		}
+	}
+
 	log.Printf("Starting proxy server on localhost:%s", config.Port)
 	if err := http.ListenAndServe("localhost:"+config.Port, proxy); err != nil {
 		errorLogger.Fatalf("ListenAndServe: %v", err)
@@ -80,12 +146,70 @@ func loadConfig(filename string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if config.CACertPath == "" {
+		config.CACertPath = "certs/ca.pem"
+	}
+	if config.CAKeyPath == "" {
+		config.CAKeyPath = "certs/ca.key"
+	}
+	if config.CertCacheSize == 0 {
+		config.CertCacheSize = 1024
+	}
+	if config.ProxyConnectTimeout == 0 {
+		config.ProxyConnectTimeout = 10
+	}
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = 30
+	}
+
 	return &config, nil
 }
 
-func redirectHandler(w http.ResponseWriter, r *http.Request, targetServer string, requestLogger, responseLogger, errorLogger *log.Logger) {
-	// Log the request
-	logRequest(r, requestLogger)
+// watchForConfigReload reloads config.yaml and recompiles its rules
+// whenever the process receives SIGHUP, so rule changes take effect
+// without a restart.
+func watchForConfigReload(rules *ruleEngine, errorLogger *log.Logger) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for range sighup {
+			newConfig, err := loadConfig("config.yaml")
+			if err != nil {
+				errorLogger.Printf("Failed to reload config.yaml: %v", err)
+				continue
+			}
+
+			compiled, err := compileRules(newConfig.Rules)
+			if err != nil {
+				errorLogger.Printf("Failed to compile rules from reloaded config: %v", err)
+				continue
+			}
+
+			rules.set(compiled)
+			log.Printf("Reloaded %d rule(s) from config.yaml", len(compiled))
+		}
+	}()
+}
+
+func redirectHandler(w http.ResponseWriter, r *http.Request, targetServer string, rules *ruleEngine, pool *proxyPool, connectTimeout time.Duration, txLogger *TxLogger, dumpEnabled bool, maxDumpBytes int, errorLogger *log.Logger) {
+	// Log the request, capturing the transaction ID that ties it to its response
+	txID := txLogger.LogRequest(r)
+	// Every path out of this function must either complete the pending
+	// transaction via LogResponse or cancel it here, or the pendingTx
+	// entry leaks forever (see txlog.go's TxLogger.pending).
+	responded := false
+	defer func() {
+		if !responded {
+			txLogger.CancelRequest(txID)
+		}
+	}()
+
+	// Evaluate blocking/redirect/delay rules before doing any outbound work
+	if rules.applyRequestRules(w, r) {
+		return
+	}
 
 	// Parse the target server URL
 	target, err := url.Parse(targetServer)
@@ -118,8 +242,20 @@ func redirectHandler(w http.ResponseWriter, r *http.Request, targetServer string
 	// Add a new header
 	proxyReq.Header.Set("X-Added-Header", "HeaderValue")
 
-	// Send the request
-	client := &http.Client{}
+	// Select an upstream proxy (or direct connection) and send the request
+	upstream := pool.pick(target.Host)
+	client, err := clientFor(upstream, connectTimeout)
+	if err != nil {
+		http.Error(w, "Failed to build upstream client", http.StatusInternalServerError)
+		errorLogger.Printf("Failed to build upstream client: %v", err)
+		return
+	}
+
+	if upstream != nil {
+		upstream.incInFlight()
+		defer upstream.decInFlight()
+	}
+
 	resp, err := client.Do(proxyReq)
 	if err != nil {
 		http.Error(w, "Failed to connect to server", http.StatusInternalServerError)
@@ -128,8 +264,28 @@ func redirectHandler(w http.ResponseWriter, r *http.Request, targetServer string
 	}
 	defer resp.Body.Close()
 
+	// Apply header/body rewrite rules before logging and forwarding
+	if err := rules.applyResponseRules(resp, r); err != nil {
+		errorLogger.Printf("Failed to apply response rules: %v", err)
+	}
+
+	if dumpEnabled {
+		if body, err := dump.DecodeBody(resp); err != nil {
+			errorLogger.Printf("Failed to decode response body for dump: %v", err)
+		} else {
+			dump.Print(os.Stdout, dump.Transaction{
+				Method:     r.Method,
+				URL:        proxyURL.String(),
+				Status:     resp.StatusCode,
+				RespHeader: resp.Header,
+				RespBody:   body,
+			}, maxDumpBytes)
+		}
+	}
+
 	// Log the response
-	logResponse(resp, responseLogger)
+	txLogger.LogResponse(txID, resp)
+	responded = true
 
 	// Forward the response to the client
 	for key, value := range resp.Header {
@@ -142,39 +298,3 @@ func redirectHandler(w http.ResponseWriter, r *http.Request, targetServer string
 		errorLogger.Printf("Failed to copy response body: %v", err)
 	}
 }
-
-func logRequest(r *http.Request, logger *log.Logger) {
-	logger.Printf("Request: %s %s", r.Method, r.URL)
-	for name, values := range r.Header {
-		for _, value := range values {
-			logger.Printf("Request Header: %s: %s", name, value)
-		}
-	}
-
-	// Log the request body
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		logger.Printf("Failed to read request body: %v", err)
-		return
-	}
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
-	logger.Printf("Request Body: %s", body)
-}
-
-func logResponse(resp *http.Response, logger *log.Logger) {
-	logger.Printf("Response: %s", resp.Status)
-	for name, values := range resp.Header {
-		for _, value := range values {
-			logger.Printf("Response Header: %s: %s", name, value)
-		}
-	}
-
-	// Log the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		logger.Printf("Failed to read response body: %v", err)
-		return
-	}
-	resp.Body = io.NopCloser(bytes.NewBuffer(body))
-	logger.Printf("Response Body: %s", body)
-}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+
+	"go_proxy/dump"
+)
+
+// certCache is a fixed-size LRU of per-host leaf certificates minted from
+// the local CA, so repeat CONNECTs to the same host don't pay for a fresh
+// keygen and signature on every request.
+type certCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type certCacheEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newCertCache(capacity int) *certCache {
+	if capacity <= 0 {
+		capacity = 1024
+	}
+	return &certCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *certCache) get(host string) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*certCacheEntry).cert, true
+}
+
+func (c *certCache) add(host string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[host]; ok {
+		el.Value.(*certCacheEntry).cert = cert
+		c.order.MoveToFront(el)
+		return
+	}
+
+	el := c.order.PushFront(&certCacheEntry{host: host, cert: cert})
+	c.entries[host] = el
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*certCacheEntry).host)
+	}
+}
+
+// mitmInterceptor owns the CA used to sign per-host leaf certificates and
+// the cache of certificates minted from it.
+type mitmInterceptor struct {
+	ca    tls.Certificate
+	leaf  *x509.Certificate
+	cache *certCache
+}
+
+// setupMitm loads (or generates, on first run) the proxy's CA and wires
+// goproxy up to MITM CONNECT requests, signing a fresh leaf certificate
+// per host on demand.
+func setupMitm(config *Config, proxy *goproxy.ProxyHttpServer, rules *ruleEngine, txLogger *TxLogger, errorLogger *log.Logger) error {
+	ca, err := loadOrCreateCA(config.CACertPath, config.CAKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load or create CA: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	mitm := &mitmInterceptor{
+		ca:    *ca,
+		leaf:  leaf,
+		cache: newCertCache(config.CertCacheSize),
+	}
+
+	goproxy.GoproxyCa = *ca
+	tlsConfig := mitm.tlsConfigForHost()
+
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return &goproxy.ConnectAction{
+			Action:    goproxy.ConnectMitm,
+			TLSConfig: tlsConfig,
+		}, host
+	}))
+
+	// Decrypted requests flow through the normal OnRequest/OnResponse chain
+	// once MITM'd, so log them through the same structured transaction
+	// logger, correlating request and response via ctx.UserData.
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.UserData = txLogger.LogRequest(r)
+
+		if verdict := rules.evaluateRequestRules(r); verdict.blocked {
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, verdict.status, verdict.body)
+		} else if verdict.redirected {
+			resp := goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusFound, "")
+			resp.Header.Set("Location", verdict.redirectURL)
+			return r, resp
+		}
+
+		if config.TargetServer != "" {
+			if target, err := url.Parse(config.TargetServer); err == nil {
+				r.URL.Scheme = target.Scheme
+				r.URL.Host = target.Host
+			} else {
+				errorLogger.Printf("Invalid target server URL: %v", err)
+			}
+		}
+		return r, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil {
+			if txID, ok := ctx.UserData.(string); ok {
+				txLogger.CancelRequest(txID)
+			}
+			return resp
+		}
+		if err := rules.applyResponseRules(resp, ctx.Req); err != nil {
+			errorLogger.Printf("Failed to apply response rules: %v", err)
+		}
+
+		if config.Dump {
+			if body, err := dump.DecodeBody(resp); err != nil {
+				errorLogger.Printf("Failed to decode response body for dump: %v", err)
+			} else {
+				dump.Print(os.Stdout, dump.Transaction{
+					Method:     ctx.Req.Method,
+					URL:        ctx.Req.URL.String(),
+					Status:     resp.StatusCode,
+					RespHeader: resp.Header,
+					RespBody:   body,
+				}, config.MaxDumpBytes)
+			}
+		}
+
+		if txID, ok := ctx.UserData.(string); ok {
+			txLogger.LogResponse(txID, resp)
+		}
+		return resp
+	})
+
+	return nil
+}
+
+// tlsConfigForHost returns a per-host tls.Config generator suitable for
+// goproxy.ConnectAction.TLSConfig, minting (and caching) a leaf certificate
+// signed by our CA for whatever host/SNI the client is dialing.
+func (m *mitmInterceptor) tlsConfigForHost() func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		name := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			name = h
+		}
+
+		if cert, ok := m.cache.get(name); ok {
+			return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil
+		}
+
+		cert, err := m.mintLeafCert(name)
+		if err != nil {
+			return nil, err
+		}
+		m.cache.add(name, cert)
+		return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil
+	}
+}
+
+// mintLeafCert signs a short-lived leaf certificate for host using the
+// interceptor's CA, with host set as both CN and SAN (DNS or IP, whichever
+// fits).
+func (m *mitmInterceptor) mintLeafCert(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate leaf key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	caKey, ok := m.ca.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", m.ca.PrivateKey)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.leaf, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign leaf certificate for %s: %w", host, err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, m.leaf.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+// loadOrCreateCA loads the CA keypair from certPath/keyPath, generating and
+// persisting a new self-signed root the first time the proxy runs.
+func loadOrCreateCA(certPath, keyPath string) (*tls.Certificate, error) {
+	if _, err := os.Stat(certPath); err == nil {
+		if _, err := os.Stat(keyPath); err == nil {
+			cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load existing CA from %s/%s: %w", certPath, keyPath, err)
+			}
+			// Backfill the .der sibling for CAs created before that export
+			// existed, so upgrading in place doesn't leave it missing.
+			derPath := derPathFor(certPath)
+			if _, err := os.Stat(derPath); os.IsNotExist(err) {
+				if err := writeCertDER(derPath, cert.Certificate[0]); err != nil {
+					return nil, fmt.Errorf("failed to backfill %s: %w", derPath, err)
+				}
+			}
+			return &cert, nil
+		}
+	}
+	return generateCA(certPath, keyPath)
+}
+
+// generateCA creates a new ECDSA CA key and self-signed root certificate,
+// writing both to disk as PEM so they can be imported into a browser or OS
+// trust store.
+func generateCA(certPath, keyPath string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "go_proxy MITM CA", Organization: []string{"go_proxy"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	for _, dir := range []string{filepath.Dir(certPath), filepath.Dir(keyPath)} {
+		if dir == "." {
+			continue
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	if err := writeCertPEM(certPath, der); err != nil {
+		return nil, err
+	}
+	// Also ship a DER copy alongside the PEM: some OS/browser trust store
+	// import dialogs (notably Windows' certmgr) expect the raw DER form
+	// rather than PEM.
+	if err := writeCertDER(derPathFor(certPath), der); err != nil {
+		return nil, err
+	}
+	if err := writeKeyPEM(keyPath, key); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reload generated CA: %w", err)
+	}
+	return &cert, nil
+}
+
+// writeCertPEM writes a DER-encoded certificate to path in PEM form.
+func writeCertPEM(path string, der []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// writeCertDER writes a DER-encoded certificate to path as raw bytes, the
+// form most OS certificate stores expect for import.
+func writeCertDER(path string, der []byte) error {
+	return os.WriteFile(path, der, 0644)
+}
+
+// derPathFor derives the sibling .der path for a .pem CA certificate path,
+// e.g. "certs/ca.pem" -> "certs/ca.der".
+func derPathFor(certPath string) string {
+	ext := filepath.Ext(certPath)
+	return strings.TrimSuffix(certPath, ext) + ".der"
+}
+
+// writeKeyPEM writes an ECDSA private key to path in PEM form.
+func writeKeyPEM(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal CA key: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCertCache(2)
+
+	c.add("a.example.com", &tls.Certificate{})
+	c.add("b.example.com", &tls.Certificate{})
+	if _, ok := c.get("a.example.com"); !ok {
+		t.Fatalf("expected a.example.com to still be cached")
+	}
+
+	// a.example.com is now most-recently-used; adding a third entry should
+	// evict b.example.com, not a.example.com.
+	c.add("c.example.com", &tls.Certificate{})
+
+	if _, ok := c.get("b.example.com"); ok {
+		t.Errorf("expected b.example.com to have been evicted")
+	}
+	if _, ok := c.get("a.example.com"); !ok {
+		t.Errorf("expected a.example.com to survive eviction")
+	}
+	if _, ok := c.get("c.example.com"); !ok {
+		t.Errorf("expected c.example.com to be cached")
+	}
+}
+
+func TestLoadOrCreateCAGeneratesAndReloads(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca.key")
+
+	first, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadOrCreateCA (generate): %v", err)
+	}
+
+	derPath := derPathFor(certPath)
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Errorf("expected a loadable PEM CA at %s/%s: %v", certPath, keyPath, err)
+	}
+	if _, err := os.Stat(derPath); err != nil {
+		t.Errorf("expected a sibling DER file at %s: %v", derPath, err)
+	}
+
+	second, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadOrCreateCA (reload): %v", err)
+	}
+	if string(second.Certificate[0]) != string(first.Certificate[0]) {
+		t.Errorf("expected reloading an existing CA to return the same certificate")
+	}
+}
+
+func TestLoadOrCreateCABackfillsMissingDER(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca.key")
+
+	if _, err := loadOrCreateCA(certPath, keyPath); err != nil {
+		t.Fatalf("loadOrCreateCA (generate): %v", err)
+	}
+
+	// Simulate a CA written before the DER export existed.
+	derPath := derPathFor(certPath)
+	if err := os.Remove(derPath); err != nil {
+		t.Fatalf("remove %s: %v", derPath, err)
+	}
+
+	if _, err := loadOrCreateCA(certPath, keyPath); err != nil {
+		t.Fatalf("loadOrCreateCA (backfill): %v", err)
+	}
+	if _, err := os.Stat(derPath); err != nil {
+		t.Errorf("expected loadOrCreateCA to backfill the missing DER file: %v", err)
+	}
+}
+
+func TestMintLeafCertSignedByCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := generateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatalf("generateCA: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse CA leaf: %v", err)
+	}
+	m := &mitmInterceptor{ca: *ca, leaf: leaf, cache: newCertCache(8)}
+
+	cert, err := m.mintLeafCert("example.com")
+	if err != nil {
+		t.Fatalf("mintLeafCert: %v", err)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Fatalf("expected leaf cert chain of [leaf, ca], got %d entries", len(cert.Certificate))
+	}
+
+	minted, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse minted leaf: %v", err)
+	}
+	if err := minted.CheckSignatureFrom(leaf); err != nil {
+		t.Errorf("expected minted leaf to be signed by the CA: %v", err)
+	}
+}
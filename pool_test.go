@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func newTestPool(strategy string, healthy ...bool) *proxyPool {
+	pool := &proxyPool{strategy: strategy}
+	for i, ok := range healthy {
+		up := &upstreamProxy{Addr: string(rune('a' + i))}
+		up.setHealthy(ok)
+		pool.proxies = append(pool.proxies, up)
+	}
+	return pool
+}
+
+func TestPoolPickBypassesConfiguredDomains(t *testing.T) {
+	pool := newTestPool("round_robin", true, true)
+	pool.bypassDomains = []string{"internal.example.com"}
+
+	if up := pool.pick("api.internal.example.com"); up != nil {
+		t.Errorf("expected subdomain of a bypass domain to go direct, got %v", up.Addr)
+	}
+	if up := pool.pick("internal.example.com"); up != nil {
+		t.Errorf("expected exact bypass domain match to go direct, got %v", up.Addr)
+	}
+	if up := pool.pick("example.com"); up == nil {
+		t.Errorf("expected a non-bypassed host to pick an upstream")
+	}
+}
+
+func TestPoolPickSkipsUnhealthyProxies(t *testing.T) {
+	pool := newTestPool("round_robin", false, true)
+
+	for i := 0; i < 5; i++ {
+		up := pool.pick("example.com")
+		if up == nil || up.Addr != "b" {
+			t.Fatalf("expected only the healthy proxy to be picked, got %v", up)
+		}
+	}
+}
+
+func TestPoolPickReturnsNilWhenNoneHealthy(t *testing.T) {
+	pool := newTestPool("round_robin", false, false)
+	if up := pool.pick("example.com"); up != nil {
+		t.Errorf("expected nil when no proxy is healthy, got %v", up.Addr)
+	}
+}
+
+func TestPoolPickLeastInFlight(t *testing.T) {
+	pool := newTestPool("least_in_flight", true, true, true)
+	pool.proxies[0].incInFlight()
+	pool.proxies[0].incInFlight()
+	pool.proxies[1].incInFlight()
+	// pool.proxies[2] has 0 in flight, should always win
+
+	up := pool.pick("example.com")
+	if up != pool.proxies[2] {
+		t.Errorf("expected the proxy with 0 in-flight requests to be picked, got %v", up.Addr)
+	}
+}
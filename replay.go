@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// replayRequest is one request extracted from a transaction log, ready to
+// be re-issued against a target server.
+type replayRequest struct {
+	method     string
+	path       string
+	rawQuery   string
+	body       string
+	header     http.Header
+	wantStatus int
+}
+
+// runReplay implements the `replay` subcommand: it reads a transaction log
+// written by the proxy (see txlog.go) and re-issues every recorded request
+// against -target, reporting any response whose status no longer matches
+// what was recorded. It's meant for regression testing rule/rewrite
+// changes against a known-good capture.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	logPath := fs.String("log", "", "path to a transaction log produced by the proxy")
+	target := fs.String("target", "", "base URL to replay requests against")
+	format := fs.String("format", "json", "log format written by the proxy: json or har")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *logPath == "" || *target == "" {
+		return fmt.Errorf("replay requires -log and -target")
+	}
+
+	targetURL, err := url.Parse(*target)
+	if err != nil {
+		return fmt.Errorf("invalid -target URL: %w", err)
+	}
+
+	var requests []replayRequest
+	switch *format {
+	case "har":
+		requests, err = loadHARRequests(*logPath)
+	default:
+		requests, err = loadJSONRequests(*logPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	mismatches := 0
+
+	for _, rr := range requests {
+		replayURL := targetURL.ResolveReference(&url.URL{Path: rr.path, RawQuery: rr.rawQuery})
+
+		req, err := http.NewRequest(rr.method, replayURL.String(), strings.NewReader(rr.body))
+		if err != nil {
+			fmt.Printf("SKIP %s %s: %v\n", rr.method, rr.path, err)
+			continue
+		}
+		for name, values := range rr.header {
+			for _, v := range values {
+				req.Header.Add(name, v)
+			}
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("FAIL %s %s: %v\n", rr.method, rr.path, err)
+			mismatches++
+			continue
+		}
+		resp.Body.Close()
+
+		result := "OK"
+		if rr.wantStatus != 0 && resp.StatusCode != rr.wantStatus {
+			result = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("%s %s %s -> %d (recorded %d)\n", result, rr.method, rr.path, resp.StatusCode, rr.wantStatus)
+	}
+
+	fmt.Printf("Replayed %d request(s), %d mismatch(es)\n", len(requests), mismatches)
+	if mismatches > 0 {
+		return fmt.Errorf("%d replayed request(s) did not match the recorded status", mismatches)
+	}
+	return nil
+}
+
+// loadJSONRequests reads a newline-delimited TxRecord log (Config.LogFormat
+// == "json") and converts each record into a replayRequest.
+func loadJSONRequests(path string) ([]replayRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var out []replayRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var record TxRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("failed to parse record in %s: %w", path, err)
+		}
+
+		rr, err := recordToReplayRequest(record.Method, record.URL, record.ReqBody, record.ReqBodyB64, record.ReqHeader, record.Status)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rr)
+	}
+	return out, scanner.Err()
+}
+
+// loadHARRequests reads a newline-delimited harEntry log (Config.LogFormat
+// == "har") and converts each entry into a replayRequest.
+func loadHARRequests(path string) ([]replayRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var out []replayRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry harEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse HAR entry in %s: %w", path, err)
+		}
+
+		header := make(http.Header, len(entry.Request.Headers))
+		for _, h := range entry.Request.Headers {
+			header.Add(h.Name, h.Value)
+		}
+
+		rr, err := recordToReplayRequest(entry.Request.Method, entry.Request.URL,
+			entry.Request.Content.Text, entry.Request.Content.Encoding == "base64", header, entry.Response.Status)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rr)
+	}
+	return out, scanner.Err()
+}
+
+func recordToReplayRequest(method, rawURL, body string, bodyIsBase64 bool, header http.Header, wantStatus int) (replayRequest, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return replayRequest{}, fmt.Errorf("invalid recorded URL %q: %w", rawURL, err)
+	}
+
+	if bodyIsBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return replayRequest{}, fmt.Errorf("invalid base64 body for %s: %w", rawURL, err)
+		}
+		body = string(decoded)
+	}
+
+	return replayRequest{
+		method:     method,
+		path:       parsed.Path,
+		rawQuery:   parsed.RawQuery,
+		body:       body,
+		header:     header,
+		wantStatus: wantStatus,
+	}, nil
+}
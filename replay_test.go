@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadJSONRequests(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "transactions.json")
+
+	body := base64.StdEncoding.EncodeToString([]byte{0x89, 0x50, 0x4e, 0x47})
+	record := `{"method":"POST","url":"http://example.com/upload?x=1","request_body":"` + body + `","request_body_base64":true,"status":201}` + "\n"
+	if err := os.WriteFile(path, []byte(record), 0644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+
+	reqs, err := loadJSONRequests(path)
+	if err != nil {
+		t.Fatalf("loadJSONRequests: %v", err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	rr := reqs[0]
+	if rr.method != "POST" || rr.path != "/upload" || rr.rawQuery != "x=1" {
+		t.Errorf("unexpected parsed request: %+v", rr)
+	}
+	if rr.wantStatus != 201 {
+		t.Errorf("expected wantStatus 201, got %d", rr.wantStatus)
+	}
+	if rr.body != string([]byte{0x89, 0x50, 0x4e, 0x47}) {
+		t.Errorf("expected base64 body to be decoded, got %q", rr.body)
+	}
+}
+
+func TestLoadHARRequests(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "transactions.har")
+
+	entry := `{"request":{"method":"GET","url":"http://example.com/path?a=b","headers":[{"name":"X-Test","value":"1"}],"content":{"text":"hello"}},"response":{"status":200}}` + "\n"
+	if err := os.WriteFile(path, []byte(entry), 0644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+
+	reqs, err := loadHARRequests(path)
+	if err != nil {
+		t.Fatalf("loadHARRequests: %v", err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	rr := reqs[0]
+	if rr.method != "GET" || rr.path != "/path" || rr.rawQuery != "a=b" {
+		t.Errorf("unexpected parsed request: %+v", rr)
+	}
+	if rr.body != "hello" {
+		t.Errorf("expected body %q, got %q", "hello", rr.body)
+	}
+	if got := rr.header.Get("X-Test"); got != "1" {
+		t.Errorf("expected header X-Test=1, got %q", got)
+	}
+	if rr.wantStatus != 200 {
+		t.Errorf("expected wantStatus 200, got %d", rr.wantStatus)
+	}
+}
+
+func TestRecordToReplayRequestInvalidURL(t *testing.T) {
+	if _, err := recordToReplayRequest(http.MethodGet, "://bad-url", "", false, nil, 0); err == nil {
+		t.Errorf("expected an error for an unparsable recorded URL")
+	}
+}
+
+func TestRecordToReplayRequestInvalidBase64(t *testing.T) {
+	if _, err := recordToReplayRequest(http.MethodGet, "http://example.com/", "not-base64!!", true, nil, 0); err == nil {
+		t.Errorf("expected an error for invalid base64 body")
+	}
+}
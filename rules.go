@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RuleConfig describes one traffic rule: a match predicate plus exactly one
+// action to take when it fires. It is loaded straight from the `rules`
+// section of config.yaml.
+type RuleConfig struct {
+	Name  string    `yaml:"name"`
+	Match RuleMatch `yaml:"match"`
+
+	// Action selects which of the fields below apply: "block", "redirect",
+	// "rewrite_header", "rewrite_body" or "delay".
+	Action string `yaml:"action"`
+
+	// block
+	Status int    `yaml:"status"`
+	Body   string `yaml:"body"`
+
+	// redirect
+	RedirectURL string `yaml:"redirect_url"`
+
+	// rewrite_header
+	HeaderOp    string `yaml:"header_op"` // add, set, remove
+	HeaderName  string `yaml:"header_name"`
+	HeaderValue string `yaml:"header_value"`
+
+	// rewrite_body
+	BodyPattern     string `yaml:"body_pattern"`
+	BodyReplacement string `yaml:"body_replacement"`
+
+	// delay
+	DelayMs int `yaml:"delay_ms"`
+}
+
+// RuleMatch selects which requests a RuleConfig applies to. Empty patterns
+// match everything; non-empty patterns are compiled as regular expressions.
+type RuleMatch struct {
+	Method      string `yaml:"method"`
+	HostPattern string `yaml:"host_pattern"`
+	URLPattern  string `yaml:"url_pattern"`
+}
+
+// compiledRule is a RuleConfig with its regular expressions pre-compiled so
+// matching doesn't recompile on every request.
+type compiledRule struct {
+	config RuleConfig
+
+	hostRe *regexp.Regexp
+	urlRe  *regexp.Regexp
+	bodyRe *regexp.Regexp
+}
+
+// compileRules validates and compiles a set of RuleConfigs, as read from
+// config.yaml, into a form ready for matching.
+func compileRules(configs []RuleConfig) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(configs))
+	for _, rc := range configs {
+		cr := compiledRule{config: rc}
+
+		if rc.Match.HostPattern != "" {
+			re, err := regexp.Compile(rc.Match.HostPattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid host_pattern: %w", rc.Name, err)
+			}
+			cr.hostRe = re
+		}
+		if rc.Match.URLPattern != "" {
+			re, err := regexp.Compile(rc.Match.URLPattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid url_pattern: %w", rc.Name, err)
+			}
+			cr.urlRe = re
+		}
+		if rc.Action == "rewrite_body" && rc.BodyPattern != "" {
+			re, err := regexp.Compile(rc.BodyPattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid body_pattern: %w", rc.Name, err)
+			}
+			cr.bodyRe = re
+		}
+
+		compiled = append(compiled, cr)
+	}
+	return compiled, nil
+}
+
+func (cr compiledRule) matches(r *http.Request) bool {
+	if cr.config.Match.Method != "" && cr.config.Match.Method != r.Method {
+		return false
+	}
+	if cr.hostRe != nil && !cr.hostRe.MatchString(r.Host) {
+		return false
+	}
+	if cr.urlRe != nil && !cr.urlRe.MatchString(r.URL.String()) {
+		return false
+	}
+	return true
+}
+
+// ruleEngine holds the active, compiled rule set and can be swapped out
+// wholesale (see watchForConfigReload in main.go) without blocking
+// in-flight requests.
+type ruleEngine struct {
+	mu    sync.RWMutex
+	rules []compiledRule
+}
+
+func newRuleEngine() *ruleEngine {
+	return &ruleEngine{}
+}
+
+func (e *ruleEngine) set(rules []compiledRule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+}
+
+func (e *ruleEngine) snapshot() []compiledRule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.rules
+}
+
+// ruleVerdict is the outcome of evaluating the request-side rules: at most
+// one of blocked/redirected is set, since the first matching block/redirect
+// rule short-circuits the rest. Callers that can't write directly to an
+// http.ResponseWriter (e.g. the MITM path in mitm.go) use this to build
+// their own response.
+type ruleVerdict struct {
+	blocked bool
+	status  int
+	body    string
+
+	redirected  bool
+	redirectURL string
+}
+
+// evaluateRequestRules runs the active rules against an outbound request,
+// applying delay/header-rewrite side effects in place and stopping at the
+// first block or redirect.
+func (e *ruleEngine) evaluateRequestRules(r *http.Request) ruleVerdict {
+	for _, cr := range e.snapshot() {
+		if !cr.matches(r) {
+			continue
+		}
+
+		switch cr.config.Action {
+		case "block":
+			status := cr.config.Status
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			return ruleVerdict{blocked: true, status: status, body: cr.config.Body}
+
+		case "redirect":
+			return ruleVerdict{redirected: true, redirectURL: cr.config.RedirectURL}
+
+		case "delay":
+			if cr.config.DelayMs > 0 {
+				time.Sleep(time.Duration(cr.config.DelayMs) * time.Millisecond)
+			}
+
+		case "rewrite_header":
+			applyHeaderRewrite(r.Header, cr.config)
+		}
+	}
+	return ruleVerdict{}
+}
+
+// applyRequestRules evaluates the active rules against an outbound request.
+// It returns true if the request was fully handled (blocked or redirected)
+// and the caller should not proxy it any further.
+func (e *ruleEngine) applyRequestRules(w http.ResponseWriter, r *http.Request) bool {
+	verdict := e.evaluateRequestRules(r)
+	switch {
+	case verdict.blocked:
+		w.WriteHeader(verdict.status)
+		io.WriteString(w, verdict.body)
+		return true
+
+	case verdict.redirected:
+		http.Redirect(w, r, verdict.redirectURL, http.StatusFound)
+		return true
+	}
+	return false
+}
+
+// applyResponseRules evaluates the active rules against an inbound response,
+// rewriting headers and/or the body in place.
+func (e *ruleEngine) applyResponseRules(resp *http.Response, r *http.Request) error {
+	for _, cr := range e.snapshot() {
+		if !cr.matches(r) {
+			continue
+		}
+
+		switch cr.config.Action {
+		case "rewrite_header":
+			applyHeaderRewrite(resp.Header, cr.config)
+
+		case "rewrite_body":
+			if cr.bodyRe == nil {
+				continue
+			}
+			raw, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return fmt.Errorf("rule %q: failed to read response body: %w", cr.config.Name, err)
+			}
+			resp.Body.Close()
+			// From here on, any failure must still leave resp.Body as a
+			// fresh reader over raw before returning, so a bad rewrite
+			// degrades to "forward the original body" instead of leaving
+			// resp.Body closed/drained under a stale Content-Length.
+			resp.Body = ioutil.NopCloser(bytes.NewReader(raw))
+
+			// The body is commonly gzip/deflate-compressed (proxied requests
+			// forward the client's Accept-Encoding unchanged), so decode
+			// before matching the pattern and re-encode afterwards rather
+			// than substituting on the compressed bytes directly.
+			encoding := resp.Header.Get("Content-Encoding")
+			decoded, err := decodeContentEncoding(raw, encoding)
+			if err != nil {
+				return fmt.Errorf("rule %q: failed to decode response body (%s): %w", cr.config.Name, encoding, err)
+			}
+
+			rewritten := cr.bodyRe.ReplaceAll(decoded, []byte(cr.config.BodyReplacement))
+
+			encoded, err := encodeContentEncoding(rewritten, encoding)
+			if err != nil {
+				return fmt.Errorf("rule %q: failed to re-encode response body (%s): %w", cr.config.Name, encoding, err)
+			}
+
+			resp.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+			resp.ContentLength = int64(len(encoded))
+			resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(encoded)))
+		}
+	}
+	return nil
+}
+
+// decodeContentEncoding decompresses body per the response's
+// Content-Encoding (gzip or deflate), passing it through unchanged for
+// anything else.
+func decodeContentEncoding(body []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	case "deflate":
+		fl := flate.NewReader(bytes.NewReader(body))
+		defer fl.Close()
+		return ioutil.ReadAll(fl)
+	default:
+		return body, nil
+	}
+}
+
+// encodeContentEncoding re-compresses body to match the Content-Encoding it
+// was decoded from, so a rewritten body stays valid for the encoding
+// already promised to the client in the response headers.
+func encodeContentEncoding(body []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "deflate":
+		var buf bytes.Buffer
+		fl, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fl.Write(body); err != nil {
+			return nil, err
+		}
+		if err := fl.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return body, nil
+	}
+}
+
+func applyHeaderRewrite(header http.Header, rc RuleConfig) {
+	switch rc.HeaderOp {
+	case "add":
+		header.Add(rc.HeaderName, rc.HeaderValue)
+	case "set":
+		header.Set(rc.HeaderName, rc.HeaderValue)
+	case "remove":
+		header.Del(rc.HeaderName)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuleMatching(t *testing.T) {
+	compiled, err := compileRules([]RuleConfig{
+		{
+			Name:   "block-ads",
+			Match:  RuleMatch{HostPattern: `^ads\.example\.com$`},
+			Action: "block",
+		},
+	})
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+	engine := newRuleEngine()
+	engine.set(compiled)
+
+	blocked := httptest.NewRequest(http.MethodGet, "http://ads.example.com/track", nil)
+	blocked.Host = "ads.example.com"
+	verdict := engine.evaluateRequestRules(blocked)
+	if !verdict.blocked {
+		t.Fatalf("expected matching host to be blocked")
+	}
+	if verdict.status != http.StatusForbidden {
+		t.Errorf("expected default block status 403, got %d", verdict.status)
+	}
+
+	allowed := httptest.NewRequest(http.MethodGet, "http://example.com/track", nil)
+	allowed.Host = "example.com"
+	if v := engine.evaluateRequestRules(allowed); v.blocked {
+		t.Errorf("expected non-matching host to pass through, got blocked verdict: %+v", v)
+	}
+}
+
+func TestEvaluateRequestRulesRedirect(t *testing.T) {
+	compiled, err := compileRules([]RuleConfig{
+		{
+			Name:        "redirect-old",
+			Match:       RuleMatch{URLPattern: `/old$`},
+			Action:      "redirect",
+			RedirectURL: "http://example.com/new",
+		},
+	})
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+	engine := newRuleEngine()
+	engine.set(compiled)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/old", nil)
+	verdict := engine.evaluateRequestRules(req)
+	if !verdict.redirected || verdict.redirectURL != "http://example.com/new" {
+		t.Fatalf("expected redirect verdict to http://example.com/new, got %+v", verdict)
+	}
+}
+
+func TestApplyResponseRulesRewriteBody(t *testing.T) {
+	compiled, err := compileRules([]RuleConfig{
+		{
+			Name:            "censor",
+			Match:           RuleMatch{},
+			Action:          "rewrite_body",
+			BodyPattern:     "secret",
+			BodyReplacement: "REDACTED",
+		},
+	})
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+	engine := newRuleEngine()
+	engine.set(compiled)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp := &http.Response{
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(bytes.NewBufferString("the secret is out")),
+	}
+
+	if err := engine.applyResponseRules(resp, req); err != nil {
+		t.Fatalf("applyResponseRules: %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "the REDACTED is out" {
+		t.Errorf("expected rewritten body, got %q", body)
+	}
+}
+
+func TestApplyResponseRulesRewriteBodyGzipRoundTrip(t *testing.T) {
+	compiled, err := compileRules([]RuleConfig{
+		{
+			Name:            "censor",
+			Match:           RuleMatch{},
+			Action:          "rewrite_body",
+			BodyPattern:     "secret",
+			BodyReplacement: "REDACTED",
+		},
+	})
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+	engine := newRuleEngine()
+	engine.set(compiled)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("the secret is out"))
+	gz.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:   ioutil.NopCloser(bytes.NewReader(buf.Bytes())),
+	}
+
+	if err := engine.applyResponseRules(resp, req); err != nil {
+		t.Fatalf("applyResponseRules: %v", err)
+	}
+
+	raw, _ := ioutil.ReadAll(resp.Body)
+	gzr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("rewritten body is not valid gzip: %v", err)
+	}
+	decoded, _ := ioutil.ReadAll(gzr)
+	if string(decoded) != "the REDACTED is out" {
+		t.Errorf("expected rewritten decompressed body, got %q", decoded)
+	}
+}
+
+func TestApplyResponseRulesRewriteBodyMalformedEncodingPassesThrough(t *testing.T) {
+	compiled, err := compileRules([]RuleConfig{
+		{
+			Name:            "censor",
+			Match:           RuleMatch{},
+			Action:          "rewrite_body",
+			BodyPattern:     "secret",
+			BodyReplacement: "REDACTED",
+		},
+	})
+	if err != nil {
+		t.Fatalf("compileRules: %v", err)
+	}
+	engine := newRuleEngine()
+	engine.set(compiled)
+
+	original := "the secret is out, not actually gzipped"
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:   ioutil.NopCloser(bytes.NewBufferString(original)),
+	}
+
+	if err := engine.applyResponseRules(resp, req); err == nil {
+		t.Fatalf("expected an error decoding a non-gzip body under Content-Encoding: gzip")
+	}
+
+	// The failed rewrite must still leave a readable body over the
+	// original bytes rather than a closed/drained reader.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("resp.Body unreadable after failed rewrite: %v", err)
+	}
+	if string(body) != original {
+		t.Errorf("expected original body preserved after failed rewrite, got %q", body)
+	}
+}
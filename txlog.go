@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go_proxy/dump"
+)
+
+// TxRecord is one logged transaction: a request paired with its response,
+// correlated by ID. It's the unit written by TxLogger regardless of the
+// configured output format.
+type TxRecord struct {
+	ID         string      `json:"id"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	ReqHeader  http.Header `json:"request_headers"`
+	ReqBody    string      `json:"request_body"`
+	ReqBodyB64 bool        `json:"request_body_base64"`
+
+	Status      int         `json:"status"`
+	RespHeader  http.Header `json:"response_headers"`
+	RespBody    string      `json:"response_body"`
+	RespBodyB64 bool        `json:"response_body_base64"`
+
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// pendingTx holds the request-side data captured by LogRequest until the
+// matching response arrives and the full record can be written out.
+type pendingTx struct {
+	id        string
+	start     time.Time
+	method    string
+	url       string
+	reqHeader http.Header
+	reqBody   []byte
+}
+
+// TxLogger is the structured, rotating replacement for the old
+// line-oriented request/response *log.Logger pair: every request/response
+// pair becomes one TxRecord, written in the configured format (text, json
+// or har).
+type TxLogger struct {
+	format string
+
+	mu      sync.Mutex
+	out     *rotatingWriter
+	pending sync.Map // id -> *pendingTx
+}
+
+// NewTxLogger opens (creating if necessary) path for structured transaction
+// logging. format is one of "text", "json" or "har"; bufSize sizes the
+// buffered writer that sits in front of the file so most requests don't pay
+// for a syscall; maxBytes triggers rotation (path -> path.1) once exceeded.
+func NewTxLogger(path, format string, bufSize int, maxBytes int64) (*TxLogger, error) {
+	out, err := newRotatingWriter(path, bufSize, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = "text"
+	}
+	return &TxLogger{format: format, out: out}, nil
+}
+
+// LogRequest captures the request side of a transaction and returns the
+// transaction ID that must be passed to LogResponse to complete it.
+func (l *TxLogger) LogRequest(r *http.Request) string {
+	id := newTxID()
+
+	body, _ := readAndRestoreBody(&r.Body)
+
+	l.pending.Store(id, &pendingTx{
+		id:        id,
+		start:     time.Now(),
+		method:    r.Method,
+		url:       r.URL.String(),
+		reqHeader: r.Header.Clone(),
+		reqBody:   body,
+	})
+	return id
+}
+
+// CancelRequest discards the pending transaction started by LogRequest(id)
+// without writing a record. Callers that bail out of handling a request
+// before a response exists (rule-blocked requests, handler errors) must
+// call this so the entry doesn't stay in pending forever.
+func (l *TxLogger) CancelRequest(id string) {
+	l.pending.Delete(id)
+}
+
+// LogResponse completes the transaction started by LogRequest(id), writing
+// one record containing both sides.
+func (l *TxLogger) LogResponse(id string, resp *http.Response) {
+	v, ok := l.pending.LoadAndDelete(id)
+	if !ok {
+		return
+	}
+	pending := v.(*pendingTx)
+
+	body, _ := readAndRestoreBody(&resp.Body)
+
+	reqText, reqB64 := encodeBody(pending.reqBody)
+	respText, respB64 := encodeBody(body)
+
+	record := TxRecord{
+		ID:          id,
+		Timestamp:   pending.start,
+		Method:      pending.method,
+		URL:         pending.url,
+		ReqHeader:   pending.reqHeader,
+		ReqBody:     reqText,
+		ReqBodyB64:  reqB64,
+		Status:      resp.StatusCode,
+		RespHeader:  resp.Header.Clone(),
+		RespBody:    respText,
+		RespBodyB64: respB64,
+		DurationMs:  time.Since(pending.start).Milliseconds(),
+	}
+
+	l.write(record)
+}
+
+func (l *TxLogger) write(record TxRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch l.format {
+	case "json":
+		l.writeJSON(record)
+	case "har":
+		l.writeHAR(record)
+	default:
+		l.writeText(record)
+	}
+}
+
+func (l *TxLogger) writeJSON(record TxRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	l.out.Write(append(data, '\n'))
+}
+
+func (l *TxLogger) writeText(record TxRecord) {
+	fmt.Fprintf(l.out, "[%s] %s %s -> %d (%dms) id=%s\n",
+		record.Timestamp.Format(time.RFC3339), record.Method, record.URL,
+		record.Status, record.DurationMs, record.ID)
+}
+
+// harEntry is a minimal subset of the HAR 1.2 "entries" schema, enough to
+// round-trip through the replay subcommand.
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            int64     `json:"time"`
+	Request         harMsg    `json:"request"`
+	Response        harMsg    `json:"response"`
+}
+
+type harMsg struct {
+	Method  string      `json:"method,omitempty"`
+	URL     string      `json:"url,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Headers []harHeader `json:"headers"`
+	Content harContent  `json:"content"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func (l *TxLogger) writeHAR(record TxRecord) {
+	entry := harEntry{
+		StartedDateTime: record.Timestamp,
+		Time:            record.DurationMs,
+		Request: harMsg{
+			Method:  record.Method,
+			URL:     record.URL,
+			Headers: headersToHAR(record.ReqHeader),
+			Content: harContent{Text: record.ReqBody, Encoding: b64Encoding(record.ReqBodyB64)},
+		},
+		Response: harMsg{
+			Status:  record.Status,
+			Headers: headersToHAR(record.RespHeader),
+			Content: harContent{Text: record.RespBody, Encoding: b64Encoding(record.RespBodyB64)},
+		},
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.out.Write(append(data, '\n'))
+}
+
+func headersToHAR(h http.Header) []harHeader {
+	out := make([]harHeader, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			out = append(out, harHeader{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+func b64Encoding(isB64 bool) string {
+	if isB64 {
+		return "base64"
+	}
+	return ""
+}
+
+// readAndRestoreBody drains body, returns its bytes, and replaces body with
+// a fresh reader over the same bytes so downstream code can still read it.
+func readAndRestoreBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(*body)
+	if err != nil {
+		return nil, err
+	}
+	*body = ioutil.NopCloser(bytes.NewBuffer(data))
+	return data, nil
+}
+
+// encodeBody returns body as text when it looks printable, or base64 when
+// http.DetectContentType flags it as binary.
+func encodeBody(body []byte) (text string, isBase64 bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+	contentType := http.DetectContentType(body)
+	if dump.IsBinary(contentType) {
+		return base64.StdEncoding.EncodeToString(body), true
+	}
+	return string(body), false
+}
+
+// logFileExtension picks a filename suffix matching the configured log
+// format so "logs/transactions.json" and "logs/transactions.har" don't
+// collide if the format is changed between runs.
+func logFileExtension(format string) string {
+	switch format {
+	case "har":
+		return "har"
+	case "json":
+		return "json"
+	default:
+		return "log"
+	}
+}
+
+func newTxID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// rotatingWriter is a buffered, size-limited io.Writer: once the file's
+// size (what it held when opened plus what has been written since) exceeds
+// maxBytes, the current
+// file is rotated to path+".1" (overwriting any previous rotation) and a
+// fresh file is opened in its place.
+type rotatingWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	bufSize  int
+
+	file    *os.File
+	buf     *bufio.Writer
+	written int64
+}
+
+func newRotatingWriter(path string, bufSize int, maxBytes int64) (*rotatingWriter, error) {
+	if bufSize <= 0 {
+		bufSize = 4096
+	}
+	w := &rotatingWriter{path: path, maxBytes: maxBytes, bufSize: bufSize}
+	if err := w.openCurrent(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) openCurrent() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %w", w.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file %s: %w", w.path, err)
+	}
+	w.file = f
+	w.buf = bufio.NewWriterSize(f, w.bufSize)
+	w.written = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.buf.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if w.maxBytes > 0 && w.written > w.maxBytes {
+		if ferr := w.rotate(); ferr != nil {
+			return n, ferr
+		}
+	}
+	return n, nil
+}
+
+// rotate flushes and closes the current file, renames it to path+".1"
+// (replacing any older rotation), and opens a fresh file at path.
+func (w *rotatingWriter) rotate() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate log file %s: %w", w.path, err)
+	}
+	return w.openCurrent()
+}
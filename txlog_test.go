@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func pendingCount(l *TxLogger) int {
+	n := 0
+	l.pending.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestTxLoggerCancelRequestRemovesPending(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewTxLogger(filepath.Join(dir, "transactions.log"), "text", 0, 0)
+	if err != nil {
+		t.Fatalf("NewTxLogger: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/blocked", nil)
+	id := l.LogRequest(req)
+	if pendingCount(l) != 1 {
+		t.Fatalf("expected 1 pending transaction after LogRequest, got %d", pendingCount(l))
+	}
+
+	l.CancelRequest(id)
+	if pendingCount(l) != 0 {
+		t.Errorf("expected CancelRequest to remove the pending entry, got %d left", pendingCount(l))
+	}
+}
+
+func TestTxLoggerLogResponseRemovesPending(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewTxLogger(filepath.Join(dir, "transactions.log"), "text", 0, 0)
+	if err != nil {
+		t.Fatalf("NewTxLogger: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	id := l.LogRequest(req)
+
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: http.NoBody}
+	l.LogResponse(id, resp)
+
+	if pendingCount(l) != 0 {
+		t.Errorf("expected LogResponse to remove the pending entry, got %d left", pendingCount(l))
+	}
+}
+
+func TestRotatingWriterRotatesPastMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "transactions.log")
+
+	w, err := newRotatingWriter(path, 16, 10)
+	if err != nil {
+		t.Fatalf("newRotatingWriter: %v", err)
+	}
+
+	if _, err := w.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := w.Write([]byte("more-bytes-after-rotation")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w.buf.Flush()
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("expected rotated file %s.1 to exist: %v", path, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected fresh file %s to exist after rotation: %v", path, err)
+	}
+}